@@ -1,6 +1,7 @@
 package pmapi
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -17,28 +18,38 @@ type ClientManager struct {
 	// create other types of clients (e.g. for integration tests).
 	newClient func(userID string) Client
 
-	config       *ClientConfig
-	roundTripper http.RoundTripper
+	config             *ClientConfig
+	roundTripper       http.RoundTripper
+	roundTripperLocker sync.RWMutex
 
 	clients       map[string]Client
 	clientsLocker sync.Locker
 
 	tokens       map[string]string
 	tokensLocker sync.Locker
+	tokenCache   TokenCache
 
-	expirations       map[string]*tokenExpiration
-	expirationsLocker sync.Locker
+	scheduler *expirationScheduler
 
 	bridgeAuths chan ClientAuth
 	clientAuths chan ClientAuth
+	closeAuths  chan struct{}
 
 	host, scheme string
 	hostLocker   sync.RWMutex
 
 	allowProxy       bool
-	proxyProvider    *proxyProvider
+	proxyProvider    reachableServerFinder
 	proxyUseDuration time.Duration
 
+	hooksLocker    sync.Locker
+	onProxySwitch  []func(oldHost, newHost string)
+	onTokenRefresh []func(userID string, err error)
+
+	contactLocker   sync.Locker
+	lastContact     time.Time
+	healthFreshness time.Duration
+
 	idGen idGen
 
 	log *logrus.Entry
@@ -57,14 +68,31 @@ type ClientAuth struct {
 	Auth   *Auth
 }
 
-// tokenExpiration manages the expiration of an access token.
-type tokenExpiration struct {
-	timer  *time.Timer
-	cancel chan (struct{})
+// reachableServerFinder is the part of *proxyProvider that switchToReachableServer depends
+// on. It is abstracted out so tests can inject a fake instead of exercising real DoH lookups.
+type reachableServerFinder interface {
+	findReachableServer() (string, error)
+}
+
+// proxyUseUpdateInterval is how often proxyUseSeconds is refreshed while a proxy is actively in
+// use, so the gauge tracks time spent so far rather than jumping from zero straight to
+// proxyUseDuration once the window closes.
+const proxyUseUpdateInterval = time.Minute
+
+// ClientManagerOption is used to configure optional behaviour of a ClientManager at construction time.
+type ClientManagerOption func(cm *ClientManager)
+
+// WithTokenCache configures the ClientManager to read through and write through the given TokenCache
+// instead of keeping tokens in memory only. Any tokens already present in the cache are loaded
+// immediately so that users who were authenticated before the last restart don't need to reauth.
+func WithTokenCache(tc TokenCache) ClientManagerOption {
+	return func(cm *ClientManager) {
+		cm.tokenCache = tc
+	}
 }
 
 // NewClientManager creates a new ClientMan which manages clients configured with the given client config.
-func NewClientManager(config *ClientConfig) (cm *ClientManager) {
+func NewClientManager(config *ClientConfig, opts ...ClientManagerOption) (cm *ClientManager) {
 	cm = &ClientManager{
 		config:       config,
 		roundTripper: http.DefaultTransport,
@@ -74,9 +102,7 @@ func NewClientManager(config *ClientConfig) (cm *ClientManager) {
 
 		tokens:       make(map[string]string),
 		tokensLocker: &sync.Mutex{},
-
-		expirations:       make(map[string]*tokenExpiration),
-		expirationsLocker: &sync.Mutex{},
+		tokenCache:   newMemoryTokenCache(),
 
 		host:       RootURL,
 		scheme:     rootScheme,
@@ -84,10 +110,16 @@ func NewClientManager(config *ClientConfig) (cm *ClientManager) {
 
 		bridgeAuths: make(chan ClientAuth),
 		clientAuths: make(chan ClientAuth),
+		closeAuths:  make(chan struct{}),
 
 		proxyProvider:    newProxyProvider(dohProviders, proxyQuery),
 		proxyUseDuration: proxyUseDuration,
 
+		hooksLocker: &sync.Mutex{},
+
+		contactLocker:   &sync.Mutex{},
+		healthFreshness: defaultHealthFreshness,
+
 		log: logrus.WithField("pkg", "pmapi-manager"),
 	}
 
@@ -95,18 +127,62 @@ func NewClientManager(config *ClientConfig) (cm *ClientManager) {
 		return newClient(cm, userID)
 	}
 
+	cm.scheduler = newExpirationScheduler(defaultRefreshWorkers, cm.refreshToken)
+
+	for _, opt := range opts {
+		opt(cm)
+	}
+
+	cm.loadTokensFromCache()
+
 	go cm.forwardClientAuths()
 
 	return cm
 }
 
+// Close stops the expiration scheduler and the goroutine forwarding client auths to the
+// bridge, so that a ClientManager can be shut down cleanly instead of leaking goroutines.
+func (cm *ClientManager) Close() {
+	cm.scheduler.Close()
+	close(cm.closeAuths)
+}
+
 func (cm *ClientManager) SetClientConstructor(f func(userID string) Client) {
 	cm.newClient = f
 }
 
-// SetRoundTripper sets the roundtripper used by clients created by this client manager.
-func (cm *ClientManager) SetRoundTripper(rt http.RoundTripper) {
-	cm.roundTripper = rt
+// loadTokensFromCache scans the configured TokenCache on startup and populates cm.tokens with
+// whatever is already there, so that previously-authenticated users can resume without being
+// prompted to reauth. A zero expiration means the token was cached by SetTokenIfUnset and
+// never expires, so it is loaded without being scheduled. Any other entry whose expiration
+// has already passed is skipped; the normal AuthRefresh flow is responsible for renewing
+// anything close to expiry.
+func (cm *ClientManager) loadTokensFromCache() {
+	userIDs, err := cm.tokenCache.UserIDs()
+	if err != nil {
+		cm.log.WithError(err).Warn("Failed to list cached tokens")
+		return
+	}
+
+	for _, userID := range userIDs {
+		token, expiration, err := cm.tokenCache.Get(userID)
+		if err != nil {
+			cm.log.WithField("userID", userID).WithError(err).Warn("Failed to load cached token")
+			continue
+		}
+
+		if expiration.IsZero() {
+			cm.tokens[userID] = token
+			continue
+		}
+
+		if !expiration.After(time.Now()) {
+			continue
+		}
+
+		cm.tokens[userID] = token
+		cm.scheduler.Schedule(userID, expiration)
+	}
 }
 
 // GetClient returns a client for the given userID.
@@ -120,6 +196,7 @@ func (cm *ClientManager) GetClient(userID string) Client {
 	}
 
 	cm.clients[userID] = cm.newClient(userID)
+	managedClientsGauge.Set(float64(len(cm.clients)))
 
 	return cm.clients[userID]
 }
@@ -129,25 +206,66 @@ func (cm *ClientManager) GetAnonymousClient() Client {
 	return cm.GetClient(fmt.Sprintf("anonymous-%v", cm.idGen.next()))
 }
 
-// LogoutClient logs out the client with the given userID and ensures its sensitive data is successfully cleared.
-func (cm *ClientManager) LogoutClient(userID string) {
+// LogoutClient tells the API to invalidate the auth for userID, using ctx so the caller can
+// time out, cancel, or retry with backoff if the API is unreachable. Unlike the old
+// LogoutClient, it does not retry internally and does not touch local state on failure: that
+// is left to the caller, who may want to ask the user whether to force-clear instead. On
+// success it calls ClearClient to wipe everything local.
+func (cm *ClientManager) LogoutClient(ctx context.Context, userID string) error {
+	cm.clientsLocker.Lock()
 	client, ok := cm.clients[userID]
+	cm.clientsLocker.Unlock()
 
 	if !ok {
-		return
+		return nil
 	}
 
-	delete(cm.clients, userID)
+	if !strings.HasPrefix(userID, "anonymous-") {
+		done := make(chan error, 1)
+		go func() { done <- client.DeleteAuth() }()
 
-	go func() {
-		if !strings.HasPrefix(userID, "anonymous-") {
-			for client.DeleteAuth() == ErrAPINotReachable {
-				cm.log.Warn("Logging out client failed because API was not reachable, retrying...")
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
 			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		client.ClearData()
-		cm.clearToken(userID)
-	}()
+	}
+
+	cm.ClearClient(userID)
+
+	return nil
+}
+
+// ClearClient wipes userID's local tokens and data and drops its client from the map, without
+// making any API call. This is the "down + expire local key, force reauth next time" half of
+// what LogoutClient used to do unconditionally; it is also what a caller should use to force a
+// local logout when the API is unreachable and the user has confirmed they want to proceed
+// anyway.
+func (cm *ClientManager) ClearClient(userID string) {
+	cm.clientsLocker.Lock()
+	client, ok := cm.clients[userID]
+	if ok {
+		delete(cm.clients, userID)
+	}
+	cm.clientsLocker.Unlock()
+
+	if !ok {
+		return
+	}
+
+	managedClientsGauge.Set(float64(len(cm.clients)))
+
+	// Cancel the scheduled expiration for this user so a stale refresh doesn't fire after
+	// logout. Any AuthRefresh already in flight will still complete and send its result on
+	// clientAuths, but forwardClientAuths drops it instead of forwarding it to bridgeAuths
+	// once userID is no longer in cm.clients, so no zombie auth is delivered after logout.
+	cm.scheduler.Cancel(userID)
+
+	client.ClearData()
+	cm.clearToken(userID)
 }
 
 // GetRootURL returns the full root URL (scheme+host).
@@ -207,24 +325,53 @@ func (cm *ClientManager) switchToReachableServer() (proxy string, err error) {
 
 	logrus.Info("Attempting to switch to a proxy")
 
+	oldHost := cm.host
+
 	if proxy, err = cm.proxyProvider.findReachableServer(); err != nil {
+		proxySwitchesTotal.WithLabelValues("failed").Inc()
 		err = errors.Wrap(err, "failed to find a usable proxy")
 		return
 	}
 
+	proxySwitchesTotal.WithLabelValues("succeeded").Inc()
+	cm.recordContact()
+
 	logrus.WithField("proxy", proxy).Info("Switching to a proxy")
 
 	// If the host is currently the RootURL, it's the first time we are enabling a proxy.
-	// This means we want to disable it again in 24 hours.
+	// This means we want to disable it again in 24 hours. In the meantime, refresh
+	// proxyUseSeconds periodically so it reports time spent so far rather than sitting at zero
+	// until the window closes.
 	if cm.host == RootURL {
+		proxyUseStart := time.Now()
+
 		go func() {
-			<-time.After(cm.proxyUseDuration)
-			cm.host = RootURL
+			ticker := time.NewTicker(proxyUseUpdateInterval)
+			defer ticker.Stop()
+
+			deadline := time.NewTimer(cm.proxyUseDuration)
+			defer deadline.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					proxyUseSeconds.WithLabelValues(proxy).Set(time.Since(proxyUseStart).Seconds())
+
+				case <-deadline.C:
+					proxyUseSeconds.WithLabelValues(proxy).Set(time.Since(proxyUseStart).Seconds())
+					oldHost := cm.host
+					cm.host = RootURL
+					cm.notifyProxySwitch(oldHost, RootURL)
+					return
+				}
+			}
 		}()
 	}
 
 	cm.host = proxy
 
+	cm.notifyProxySwitch(oldHost, proxy)
+
 	return
 }
 
@@ -248,11 +395,25 @@ func (cm *ClientManager) GetClientAuthChannel() chan ClientAuth {
 
 // forwardClientAuths handles all incoming auths from clients before forwarding them on the bridge auth channel.
 func (cm *ClientManager) forwardClientAuths() {
-	for auth := range cm.clientAuths {
-		logrus.Debug("ClientManager received auth from client")
-		cm.handleClientAuth(auth)
-		logrus.Debug("ClientManager is forwarding auth to bridge")
-		cm.bridgeAuths <- auth
+	for {
+		select {
+		case auth := <-cm.clientAuths:
+			logrus.Debug("ClientManager received auth from client")
+			if !cm.handleClientAuth(auth) {
+				logrus.WithField("userID", auth.UserID).Debug("Dropping auth for client that was cleared in the meantime")
+				continue
+			}
+			logrus.Debug("ClientManager is forwarding auth to bridge")
+
+			select {
+			case cm.bridgeAuths <- auth:
+			case <-cm.closeAuths:
+				return
+			}
+
+		case <-cm.closeAuths:
+			return
+		}
 	}
 }
 
@@ -269,6 +430,11 @@ func (cm *ClientManager) SetTokenIfUnset(userID, token string) {
 	logrus.WithField("userID", userID).Info("Setting token because it is currently unset")
 
 	cm.tokens[userID] = token
+
+	// This token does not expire, so cache it with a zero expiration.
+	if err := cm.tokenCache.Set(userID, token, time.Time{}); err != nil {
+		logrus.WithField("userID", userID).WithError(err).Warn("Failed to cache token")
+	}
 }
 
 // setToken sets the token for the given userID with the given expiration time.
@@ -280,27 +446,13 @@ func (cm *ClientManager) setToken(userID, token string, expiration time.Duration
 
 	cm.tokens[userID] = token
 
-	cm.setTokenExpiration(userID, expiration)
-
-	// TODO: This should be one go routine per all tokens.
-	go cm.watchTokenExpiration(userID)
-}
-
-// setTokenExpiration will ensure the token is refreshed if it expires.
-// If the token already has an expiration time set, it is replaced.
-func (cm *ClientManager) setTokenExpiration(userID string, expiration time.Duration) {
-	cm.expirationsLocker.Lock()
-	defer cm.expirationsLocker.Unlock()
-
-	if exp, ok := cm.expirations[userID]; ok {
-		exp.timer.Stop()
-		close(exp.cancel)
+	if err := cm.tokenCache.Set(userID, token, time.Now().Add(expiration)); err != nil {
+		logrus.WithField("userID", userID).WithError(err).Warn("Failed to cache token")
 	}
 
-	cm.expirations[userID] = &tokenExpiration{
-		timer:  time.NewTimer(expiration),
-		cancel: make(chan struct{}),
-	}
+	tokenTTLSeconds.Observe(expiration.Seconds())
+
+	cm.scheduler.Schedule(userID, time.Now().Add(expiration))
 }
 
 func (cm *ClientManager) clearToken(userID string) {
@@ -310,44 +462,65 @@ func (cm *ClientManager) clearToken(userID string) {
 	logrus.WithField("userID", userID).Info("Clearing token")
 
 	delete(cm.tokens, userID)
+
+	cm.scheduler.Cancel(userID)
+
+	if err := cm.tokenCache.Delete(userID); err != nil {
+		logrus.WithField("userID", userID).WithError(err).Warn("Failed to clear cached token")
+	}
 }
 
-// handleClientAuth updates or clears client authorisation based on auths received.
-func (cm *ClientManager) handleClientAuth(ca ClientAuth) {
+// handleClientAuth updates or clears client authorisation based on auths received. It returns
+// whether ca.UserID is still a managed client, which forwardClientAuths uses to decide
+// whether to forward the auth on to the bridge: once a client has been cleared (e.g. via
+// ClearClient/LogoutClient), any auth that was already in flight is a zombie and must not be
+// delivered.
+func (cm *ClientManager) handleClientAuth(ca ClientAuth) (stillManaged bool) {
 	cm.clientsLocker.Lock()
 	defer cm.clientsLocker.Unlock()
 
 	// If we aren't managing this client, there's nothing to do.
 	if _, ok := cm.clients[ca.UserID]; !ok {
 		logrus.WithField("userID", ca.UserID).Info("Not handling auth for unmanaged client")
-		return
+		return false
 	}
 
 	// If the auth is nil, we should clear the token.
 	// TODO: Maybe we should trigger a client logout here? Then we don't have to remember to log it out ourself.
 	if ca.Auth == nil {
 		cm.clearToken(ca.UserID)
-		return
+		return true
 	}
 
 	cm.setToken(ca.UserID, ca.Auth.GenToken(), time.Duration(ca.Auth.ExpiresIn)*time.Second)
+
+	return true
 }
 
-func (cm *ClientManager) watchTokenExpiration(userID string) {
-	cm.expirationsLocker.Lock()
-	expiration := cm.expirations[userID]
-	cm.expirationsLocker.Unlock()
-
-	select {
-	case <-expiration.timer.C:
-		cm.log.WithField("userID", userID).Info("Auth token expired! Refreshing")
-		if _, err := cm.clients[userID].AuthRefresh(cm.tokens[userID]); err != nil {
-			cm.log.WithField("userID", userID).
-				WithError(err).
-				Error("Token refresh failed before expiration")
-		}
+// refreshToken is called by the expirationScheduler's worker pool when a user's token is due
+// to expire. It is safe to call concurrently for different users.
+func (cm *ClientManager) refreshToken(userID string) {
+	cm.clientsLocker.Lock()
+	client, ok := cm.clients[userID]
+	cm.clientsLocker.Unlock()
 
-	case <-expiration.cancel:
-		logrus.WithField("userID", userID).Debug("Auth was refreshed before it expired")
+	if !ok {
+		logrus.WithField("userID", userID).Debug("Not refreshing token for unmanaged client")
+		return
+	}
+
+	cm.log.WithField("userID", userID).Info("Auth token expired! Refreshing")
+
+	_, err := client.AuthRefresh(cm.GetToken(userID))
+	if err != nil {
+		cm.log.WithField("userID", userID).
+			WithError(err).
+			Error("Token refresh failed before expiration")
+		tokenRefreshesTotal.WithLabelValues("failed").Inc()
+	} else {
+		tokenRefreshesTotal.WithLabelValues("succeeded").Inc()
+		cm.recordContact()
 	}
+
+	cm.notifyTokenRefresh(userID, err)
 }
\ No newline at end of file
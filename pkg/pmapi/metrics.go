@@ -0,0 +1,150 @@
+package pmapi
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultHealthFreshness is how long ago the last successful contact with the API (or an
+// active proxy) may have been for /healthz to still report healthy.
+const defaultHealthFreshness = 2 * time.Minute
+
+var (
+	managedClientsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pmapi",
+		Name:      "managed_clients",
+		Help:      "Number of clients currently managed by the ClientManager.",
+	})
+
+	tokenRefreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pmapi",
+		Name:      "token_refreshes_total",
+		Help:      "Number of AuthRefresh attempts, labeled by outcome (succeeded/failed).",
+	}, []string{"outcome"})
+
+	tokenTTLSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "pmapi",
+		Name:      "token_ttl_seconds",
+		Help:      "TTL of tokens as they are set, in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(30, 2, 12),
+	})
+
+	proxySwitchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pmapi",
+		Name:      "proxy_switches_total",
+		Help:      "Number of attempts to switch to a reachable proxy, labeled by outcome (succeeded/failed).",
+	}, []string{"outcome"})
+
+	proxyUseSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pmapi",
+		Name:      "proxy_use_seconds",
+		Help:      "Time spent so far using the current alternative proxy host, labeled by host.",
+	}, []string{"host"})
+
+	dohLookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pmapi",
+		Name:      "doh_lookups_total",
+		Help:      "Number of DoH lookups performed, labeled by provider.",
+	}, []string{"provider"})
+)
+
+// IncDoHLookup records a single DoH lookup against provider in doh_lookups_total. The proxy
+// provider does not call it, so the counter only reflects lookups reported through it.
+func IncDoHLookup(provider string) {
+	dohLookupsTotal.WithLabelValues(provider).Inc()
+}
+
+// OnProxySwitch registers f to be called whenever the ClientManager switches to an
+// alternative proxy host, or back from it to RootURL once the proxy use window ends, so that
+// the bridge frontend can surface the event without having to poll logs. DisallowProxy
+// resets the host without calling f.
+func (cm *ClientManager) OnProxySwitch(f func(oldHost, newHost string)) {
+	cm.hooksLocker.Lock()
+	defer cm.hooksLocker.Unlock()
+
+	cm.onProxySwitch = append(cm.onProxySwitch, f)
+}
+
+// OnTokenRefresh registers f to be called whenever a token refresh completes (successfully
+// or not) for userID.
+func (cm *ClientManager) OnTokenRefresh(f func(userID string, err error)) {
+	cm.hooksLocker.Lock()
+	defer cm.hooksLocker.Unlock()
+
+	cm.onTokenRefresh = append(cm.onTokenRefresh, f)
+}
+
+func (cm *ClientManager) notifyProxySwitch(oldHost, newHost string) {
+	cm.hooksLocker.Lock()
+	hooks := append([]func(string, string){}, cm.onProxySwitch...)
+	cm.hooksLocker.Unlock()
+
+	for _, hook := range hooks {
+		hook(oldHost, newHost)
+	}
+}
+
+func (cm *ClientManager) notifyTokenRefresh(userID string, err error) {
+	cm.hooksLocker.Lock()
+	hooks := append([]func(string, error){}, cm.onTokenRefresh...)
+	cm.hooksLocker.Unlock()
+
+	for _, hook := range hooks {
+		hook(userID, err)
+	}
+}
+
+// recordContact marks now as the last time we successfully reached either RootURL or an
+// active proxy. /healthz uses this to decide whether the API is currently reachable.
+func (cm *ClientManager) recordContact() {
+	cm.contactLocker.Lock()
+	defer cm.contactLocker.Unlock()
+
+	cm.lastContact = time.Now()
+}
+
+// SetHealthFreshness configures how long ago the last successful contact with the API may
+// have been for /healthz to still report healthy. The default is defaultHealthFreshness.
+func (cm *ClientManager) SetHealthFreshness(d time.Duration) {
+	cm.contactLocker.Lock()
+	defer cm.contactLocker.Unlock()
+
+	cm.healthFreshness = d
+}
+
+// MetricsHandler returns an http.Handler serving Prometheus metrics on /metrics and a
+// liveness probe on /healthz. /healthz responds 200 only while the last successful contact
+// with RootURL or an active proxy is within the configured freshness window, so external
+// supervisors and the bridge UI can distinguish "API unreachable" from "auth broken".
+func (cm *ClientManager) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", cm.serveHealthz)
+
+	return mux
+}
+
+func (cm *ClientManager) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	cm.contactLocker.Lock()
+	lastContact, freshness := cm.lastContact, cm.healthFreshness
+	cm.contactLocker.Unlock()
+
+	if freshness <= 0 {
+		freshness = defaultHealthFreshness
+	}
+
+	if lastContact.IsZero() || time.Since(lastContact) > freshness {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "last successful contact was %v ago\n", time.Since(lastContact))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
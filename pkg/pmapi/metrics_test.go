@@ -0,0 +1,48 @@
+package pmapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientManager_Healthz_UnhealthyBeforeAnyContact(t *testing.T) {
+	cm := NewClientManager(&ClientConfig{})
+	defer cm.Close()
+
+	rec := httptest.NewRecorder()
+	cm.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestClientManager_Healthz_HealthyWithinFreshnessWindow(t *testing.T) {
+	cm := NewClientManager(&ClientConfig{})
+	defer cm.Close()
+
+	cm.SetHealthFreshness(time.Minute)
+	cm.recordContact()
+
+	rec := httptest.NewRecorder()
+	cm.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestClientManager_Healthz_UnhealthyOutsideFreshnessWindow(t *testing.T) {
+	cm := NewClientManager(&ClientConfig{})
+	defer cm.Close()
+
+	cm.SetHealthFreshness(10 * time.Millisecond)
+	cm.recordContact()
+
+	time.Sleep(30 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	cm.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
@@ -0,0 +1,185 @@
+package pmapi
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newOutboundHTTPProxy starts a minimal CONNECT-capable HTTP proxy, optionally requiring the
+// given basic auth credentials, and returns its URL (with the credentials embedded, if any).
+func newOutboundHTTPProxy(t *testing.T, username, password string) (*httptest.Server, *url.URL) {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username != "" {
+			user, pass, ok := parseProxyBasicAuth(r.Header.Get("Proxy-Authorization"))
+			if !ok || user != username || pass != password {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+		}
+
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer dst.Close()
+
+		hijacker, ok := w.(http.Hijacker)
+		require.True(t, ok)
+
+		src, _, err := hijacker.Hijack()
+		require.NoError(t, err)
+		defer src.Close()
+
+		_, _ = src.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+		done := make(chan struct{}, 2)
+		go func() { _, _ = io.Copy(dst, src); done <- struct{}{} }()
+		go func() { _, _ = io.Copy(src, dst); done <- struct{}{} }()
+		<-done
+	}))
+
+	proxyURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	if username != "" {
+		proxyURL.User = url.UserPassword(username, password)
+	}
+
+	return server, proxyURL
+}
+
+func parseProxyBasicAuth(header string) (user, pass string, ok bool) {
+	const prefix = "Basic "
+
+	if !strings.HasPrefix(header, prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	user, pass, ok = strings.Cut(string(decoded), ":")
+
+	return user, pass, ok
+}
+
+func TestClientManager_SetOutboundProxy_HTTPOnly(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	proxyServer, proxyURL := newOutboundHTTPProxy(t, "", "")
+	defer proxyServer.Close()
+
+	cm := NewClientManager(&ClientConfig{})
+	require.NoError(t, cm.SetOutboundProxy(proxyURL))
+
+	resp, err := doThroughClientManager(t, cm, target.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestClientManager_SetOutboundProxy_CONNECTWithAuth(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	proxyServer, proxyURL := newOutboundHTTPProxy(t, "alice", "hunter2")
+	defer proxyServer.Close()
+
+	cm := NewClientManager(&ClientConfig{})
+	require.NoError(t, cm.SetOutboundProxy(proxyURL))
+
+	resp, err := doThroughClientManager(t, cm, target.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// fakeReachableServerFinder is a reachableServerFinder double used so proxy failover tests
+// don't depend on real DoH providers or network access.
+type fakeReachableServerFinder struct {
+	server string
+	err    error
+}
+
+func (f *fakeReachableServerFinder) findReachableServer() (string, error) {
+	return f.server, f.err
+}
+
+func TestClientManager_DoHFailoverOnly(t *testing.T) {
+	cm := NewClientManager(&ClientConfig{})
+	cm.proxyProvider = &fakeReachableServerFinder{err: errors.New("no reachable proxy in this test")}
+
+	_, err := cm.switchToReachableServer()
+	require.Error(t, err)
+}
+
+func TestClientManager_DoHFailoverOnly_Succeeds(t *testing.T) {
+	cm := NewClientManager(&ClientConfig{})
+	cm.proxyProvider = &fakeReachableServerFinder{server: "alt.example.com"}
+
+	proxy, err := cm.switchToReachableServer()
+	require.NoError(t, err)
+	require.Equal(t, "alt.example.com", proxy)
+	require.Equal(t, "alt.example.com", cm.getHost())
+}
+
+func TestClientManager_OutboundProxyAndDoHFailoverTogether(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	proxyServer, proxyURL := newOutboundHTTPProxy(t, "", "")
+	defer proxyServer.Close()
+
+	cm := NewClientManager(&ClientConfig{})
+	require.NoError(t, cm.SetOutboundProxy(proxyURL))
+
+	// Simulate a successful DoH failover by pointing the manager directly at the target
+	// host, the same way switchToReachableServer would on success.
+	cm.AllowProxy()
+	cm.host = target.Listener.Addr().String()
+
+	resp, err := doThroughClientManager(t, cm, cm.GetRootURL())
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// doThroughClientManager issues a request to target using the roundtripper currently
+// configured on cm, the same way a Client created by cm would.
+func doThroughClientManager(t *testing.T, cm *ClientManager, target string) (*http.Response, error) {
+	t.Helper()
+
+	transport, ok := cm.getRoundTripper().(*http.Transport)
+	require.True(t, ok)
+
+	transport = transport.Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec // test-only, self-signed cert
+
+	client := &http.Client{Transport: transport}
+
+	return client.Get(target)
+}
@@ -0,0 +1,235 @@
+package pmapi
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// defaultRefreshWorkers is the number of goroutines used to run AuthRefresh calls
+// triggered by the expirationScheduler. This bounds how many refreshes can be in
+// flight at once, so a single stalled network call cannot delay every other user's
+// refresh indefinitely.
+const defaultRefreshWorkers = 4
+
+// expirationEntry is a single scheduled expiration. generation is bumped every time
+// the userID's expiration is rescheduled or cancelled; an entry popped from the heap
+// whose generation no longer matches the scheduler's current generation for that
+// userID is stale and is discarded rather than acted upon.
+type expirationEntry struct {
+	deadline   time.Time
+	userID     string
+	generation uint64
+}
+
+// expirationHeap is a min-heap of expirationEntry ordered by deadline.
+type expirationHeap []*expirationEntry
+
+func (h expirationHeap) Len() int            { return len(h) }
+func (h expirationHeap) Less(i, j int) bool  { return h[i].deadline.Before(h[j].deadline) }
+func (h expirationHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expirationHeap) Push(x interface{}) { *h = append(*h, x.(*expirationEntry)) }
+
+func (h *expirationHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return entry
+}
+
+// expirationScheduler replaces one goroutine-and-timer pair per user with a single
+// goroutine that sleeps until the next token is due to expire. This avoids leaking a
+// goroutine per user on churn, and makes it possible to shut everything down cleanly
+// via Close.
+type expirationScheduler struct {
+	locker     sync.Mutex
+	heap       expirationHeap
+	generation map[string]uint64
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+
+	jobs chan string
+
+	// onExpire is invoked (on a bounded worker pool) for each userID whose token
+	// expires. It is expected to refresh the token via the API.
+	onExpire func(userID string)
+}
+
+// newExpirationScheduler creates an expirationScheduler which calls onExpire for each
+// userID whose scheduled deadline is reached, using up to workers goroutines to do so
+// concurrently.
+func newExpirationScheduler(workers int, onExpire func(userID string)) *expirationScheduler {
+	if workers <= 0 {
+		workers = defaultRefreshWorkers
+	}
+
+	s := &expirationScheduler{
+		generation: make(map[string]uint64),
+		notify:     make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		jobs:       make(chan string),
+		onExpire:   onExpire,
+	}
+
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Schedule (re)schedules userID to expire at deadline, discarding any previously
+// scheduled deadline for userID.
+func (s *expirationScheduler) Schedule(userID string, deadline time.Time) {
+	s.locker.Lock()
+	s.generation[userID]++
+	heap.Push(&s.heap, &expirationEntry{
+		deadline:   deadline,
+		userID:     userID,
+		generation: s.generation[userID],
+	})
+	s.locker.Unlock()
+
+	s.wake()
+}
+
+// Cancel discards any scheduled expiration for userID. It does not remove the
+// entry from the heap (that would require a linear scan); instead it bumps the
+// generation so the entry is recognised as stale and ignored when it is popped.
+func (s *expirationScheduler) Cancel(userID string) {
+	s.locker.Lock()
+	s.generation[userID]++
+	s.locker.Unlock()
+}
+
+// Close stops the scheduler goroutine and tells the refresh worker pool to stop taking new
+// work. It returns as soon as that is signalled: it does not wait for any in-flight onExpire
+// call to finish, since onExpire calls out to the network (AuthRefresh) and a single stalled
+// call must not be able to block shutdown. Workers still in the middle of an onExpire call
+// finish it and then exit on their own once jobs is drained.
+func (s *expirationScheduler) Close() {
+	close(s.stop)
+	<-s.done
+	close(s.jobs)
+}
+
+func (s *expirationScheduler) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run is the single goroutine responsible for waking up when the next token is due
+// to expire and handing it off to the worker pool.
+func (s *expirationScheduler) run() {
+	defer close(s.done)
+
+	timer := time.NewTimer(time.Hour)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		d, ok := s.nextDeadline()
+		if ok {
+			resetTimer(timer, time.Until(d))
+		}
+
+		select {
+		case <-s.stop:
+			return
+
+		case <-s.notify:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			continue
+
+		case <-timerC(ok, timer):
+			s.fireDue()
+		}
+	}
+}
+
+// nextDeadline returns the deadline at the head of the heap, if any, without
+// popping it.
+func (s *expirationScheduler) nextDeadline() (time.Time, bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if len(s.heap) == 0 {
+		return time.Time{}, false
+	}
+
+	return s.heap[0].deadline, true
+}
+
+// fireDue pops every entry whose deadline has passed and, for those which are not
+// stale, sends the userID to the worker pool.
+func (s *expirationScheduler) fireDue() {
+	for {
+		userID, ok := s.popDue()
+		if !ok {
+			return
+		}
+
+		select {
+		case s.jobs <- userID:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *expirationScheduler) popDue() (string, bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for len(s.heap) > 0 && !s.heap[0].deadline.After(time.Now()) {
+		entry := heap.Pop(&s.heap).(*expirationEntry)
+
+		if entry.generation != s.generation[entry.userID] {
+			// Stale: the user's token was rescheduled or cancelled since this entry
+			// was pushed onto the heap.
+			continue
+		}
+
+		return entry.userID, true
+	}
+
+	return "", false
+}
+
+func (s *expirationScheduler) work() {
+	for userID := range s.jobs {
+		s.onExpire(userID)
+	}
+}
+
+// resetTimer safely resets a stopped timer to fire after d.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	timer.Reset(d)
+}
+
+// timerC returns the timer's channel if ok is true, or a nil channel (which blocks
+// forever) if there is currently nothing scheduled.
+func timerC(ok bool, timer *time.Timer) <-chan time.Time {
+	if !ok {
+		return nil
+	}
+	return timer.C
+}
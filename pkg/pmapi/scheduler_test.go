@@ -0,0 +1,120 @@
+package pmapi
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpirationScheduler_FiresAtDeadline(t *testing.T) {
+	fired := make(chan string, 1)
+
+	s := newExpirationScheduler(1, func(userID string) { fired <- userID })
+	defer s.Close()
+
+	s.Schedule("user-1", time.Now().Add(20*time.Millisecond))
+
+	select {
+	case userID := <-fired:
+		require.Equal(t, "user-1", userID)
+	case <-time.After(time.Second):
+		t.Fatal("expected onExpire to fire for user-1")
+	}
+}
+
+func TestExpirationScheduler_CancelPreventsFire(t *testing.T) {
+	fired := make(chan string, 1)
+
+	s := newExpirationScheduler(1, func(userID string) { fired <- userID })
+	defer s.Close()
+
+	s.Schedule("user-1", time.Now().Add(20*time.Millisecond))
+	s.Cancel("user-1")
+
+	select {
+	case userID := <-fired:
+		t.Fatalf("expected no fire after cancel, got one for %q", userID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestExpirationScheduler_RescheduleDiscardsStaleEntry(t *testing.T) {
+	var mu sync.Mutex
+	var fires []string
+
+	s := newExpirationScheduler(1, func(userID string) {
+		mu.Lock()
+		fires = append(fires, userID)
+		mu.Unlock()
+	})
+	defer s.Close()
+
+	// Schedule a near deadline, then immediately reschedule to something further out. The
+	// first heap entry is now stale: it must be discarded rather than firing early.
+	s.Schedule("user-1", time.Now().Add(10*time.Millisecond))
+	s.Schedule("user-1", time.Now().Add(60*time.Millisecond))
+
+	time.Sleep(30 * time.Millisecond)
+	mu.Lock()
+	require.Empty(t, fires, "stale entry should not have fired")
+	mu.Unlock()
+
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	require.Equal(t, []string{"user-1"}, fires)
+	mu.Unlock()
+}
+
+func TestExpirationScheduler_Close(t *testing.T) {
+	s := newExpirationScheduler(1, func(userID string) {})
+
+	s.Schedule("user-1", time.Now().Add(time.Hour))
+
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close() did not return")
+	}
+}
+
+// TestExpirationScheduler_CloseDoesNotWaitForInFlightOnExpire guards against Close() blocking
+// on a stalled onExpire call (e.g. a network refresh that never returns) — the exact scenario
+// the single-goroutine scheduler was introduced to fix.
+func TestExpirationScheduler_CloseDoesNotWaitForInFlightOnExpire(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+
+	s := newExpirationScheduler(1, func(userID string) {
+		close(started)
+		<-unblock
+	})
+	defer close(unblock)
+
+	s.Schedule("user-1", time.Now().Add(10*time.Millisecond))
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("onExpire never started")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Close() waited for the in-flight onExpire call to finish")
+	}
+}
@@ -0,0 +1,282 @@
+package pmapi
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenCache persists auth tokens across bridge restarts so that a previously
+// authenticated user does not have to go through AuthRefresh (or a full
+// reauth, if the refresh token was rotated) every time the bridge starts up.
+type TokenCache interface {
+	// Get returns the cached token and its absolute expiration time for userID.
+	// It returns an error if there is no cached entry for userID.
+	Get(userID string) (token string, expiration time.Time, err error)
+
+	// Set stores token and its absolute expiration time for userID.
+	Set(userID, token string, expiration time.Time) error
+
+	// Delete removes any cached entry for userID.
+	Delete(userID string) error
+
+	// UserIDs returns the userIDs of all entries currently in the cache.
+	UserIDs() ([]string, error)
+}
+
+// memoryTokenCache is a TokenCache which only keeps entries in memory. This
+// is the default, and preserves the historical in-memory-only behaviour of
+// the ClientManager.
+type memoryTokenCache struct {
+	locker  sync.Locker
+	entries map[string]memoryTokenCacheEntry
+}
+
+type memoryTokenCacheEntry struct {
+	token      string
+	expiration time.Time
+}
+
+// newMemoryTokenCache returns a TokenCache which keeps entries in memory only.
+func newMemoryTokenCache() TokenCache {
+	return &memoryTokenCache{
+		locker:  &sync.Mutex{},
+		entries: make(map[string]memoryTokenCacheEntry),
+	}
+}
+
+func (c *memoryTokenCache) Get(userID string) (string, time.Time, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	entry, ok := c.entries[userID]
+	if !ok {
+		return "", time.Time{}, errors.New("no cached token for user")
+	}
+
+	return entry.token, entry.expiration, nil
+}
+
+func (c *memoryTokenCache) Set(userID, token string, expiration time.Time) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.entries[userID] = memoryTokenCacheEntry{token: token, expiration: expiration}
+
+	return nil
+}
+
+func (c *memoryTokenCache) Delete(userID string) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	delete(c.entries, userID)
+
+	return nil
+}
+
+func (c *memoryTokenCache) UserIDs() ([]string, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	userIDs := make([]string, 0, len(c.entries))
+	for userID := range c.entries {
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, nil
+}
+
+// TokenCacheKeySource supplies the key used to seal entries written by a FileTokenCache.
+// The bridge keychain satisfies this (it already guards the secret used to
+// encrypt other locally cached credentials), but it is abstracted here so the
+// cache can be tested without a real keychain.
+type TokenCacheKeySource interface {
+	// TokenCacheKey returns a 32-byte key suitable for use with AES-256-GCM.
+	TokenCacheKey() ([]byte, error)
+}
+
+// fileTokenCacheEntry is the on-disk, unsealed representation of a cache entry.
+type fileTokenCacheEntry struct {
+	Token      string    `json:"Token"`
+	Expiration time.Time `json:"Expiration"`
+}
+
+// FileTokenCache is a TokenCache backed by a single file on disk holding the
+// entries of all userIDs, sealed together as one blob. Entries are encrypted with a key derived from the bridge
+// keychain so that the token cache file on its own is useless to an attacker.
+type FileTokenCache struct {
+	locker sync.Locker
+	path   string
+	keys   TokenCacheKeySource
+}
+
+// NewFileTokenCache returns a TokenCache which persists sealed entries to path,
+// encrypting them with a key supplied by keys.
+func NewFileTokenCache(path string, keys TokenCacheKeySource) (TokenCache, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create token cache directory")
+	}
+
+	return &FileTokenCache{
+		locker: &sync.Mutex{},
+		path:   path,
+		keys:   keys,
+	}, nil
+}
+
+func (c *FileTokenCache) Get(userID string) (string, time.Time, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	entries, err := c.readAll()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	entry, ok := entries[userID]
+	if !ok {
+		return "", time.Time{}, errors.New("no cached token for user")
+	}
+
+	return entry.Token, entry.Expiration, nil
+}
+
+func (c *FileTokenCache) Set(userID, token string, expiration time.Time) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	entries, err := c.readAll()
+	if err != nil {
+		return err
+	}
+
+	entries[userID] = fileTokenCacheEntry{Token: token, Expiration: expiration}
+
+	return c.writeAll(entries)
+}
+
+func (c *FileTokenCache) Delete(userID string) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	entries, err := c.readAll()
+	if err != nil {
+		return err
+	}
+
+	delete(entries, userID)
+
+	return c.writeAll(entries)
+}
+
+func (c *FileTokenCache) UserIDs() ([]string, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	entries, err := c.readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]string, 0, len(entries))
+	for userID := range entries {
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, nil
+}
+
+// readAll loads and decrypts every entry currently on disk. A missing file is
+// treated as an empty cache rather than an error, so that the first run (or a
+// cache wiped by the user) starts cleanly.
+func (c *FileTokenCache) readAll() (map[string]fileTokenCacheEntry, error) {
+	sealed, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return make(map[string]fileTokenCacheEntry), nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read token cache")
+	}
+
+	if len(sealed) == 0 {
+		return make(map[string]fileTokenCacheEntry), nil
+	}
+
+	plain, err := c.unseal(sealed)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unseal token cache")
+	}
+
+	entries := make(map[string]fileTokenCacheEntry)
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal token cache")
+	}
+
+	return entries, nil
+}
+
+func (c *FileTokenCache) writeAll(entries map[string]fileTokenCacheEntry) error {
+	plain, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal token cache")
+	}
+
+	sealed, err := c.seal(plain)
+	if err != nil {
+		return errors.Wrap(err, "failed to seal token cache")
+	}
+
+	return ioutil.WriteFile(c.path, sealed, 0600)
+}
+
+func (c *FileTokenCache) seal(plain []byte) ([]byte, error) {
+	gcm, err := c.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (c *FileTokenCache) unseal(sealed []byte) ([]byte, error) {
+	gcm, err := c.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed token cache is corrupt")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func (c *FileTokenCache) gcm() (cipher.AEAD, error) {
+	key, err := c.keys.TokenCacheKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get token cache key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+
+	return cipher.NewGCM(block)
+}
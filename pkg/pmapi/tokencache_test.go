@@ -0,0 +1,125 @@
+package pmapi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fixedKeySource is a TokenCacheKeySource that always returns the same key, standing in for
+// the bridge keychain in tests.
+type fixedKeySource struct {
+	key []byte
+}
+
+func newFixedKeySource() *fixedKeySource {
+	return &fixedKeySource{key: []byte("0123456789abcdef0123456789abcdef")[:32]}
+}
+
+func (k *fixedKeySource) TokenCacheKey() ([]byte, error) {
+	return k.key, nil
+}
+
+func TestFileTokenCache_SealUnsealRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmapi-tokencache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := NewFileTokenCache(filepath.Join(dir, "tokens"), newFixedKeySource())
+	require.NoError(t, err)
+
+	expiration := time.Now().Add(time.Hour).Round(0)
+
+	require.NoError(t, cache.Set("user-1", "token-1", expiration))
+
+	token, exp, err := cache.Get("user-1")
+	require.NoError(t, err)
+	require.Equal(t, "token-1", token)
+	require.True(t, expiration.Equal(exp))
+
+	require.NoError(t, cache.Delete("user-1"))
+
+	_, _, err = cache.Get("user-1")
+	require.Error(t, err)
+}
+
+func TestFileTokenCache_SurvivesReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmapi-tokencache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens")
+	keys := newFixedKeySource()
+
+	cache, err := NewFileTokenCache(path, keys)
+	require.NoError(t, err)
+	require.NoError(t, cache.Set("user-1", "token-1", time.Time{}))
+
+	reopened, err := NewFileTokenCache(path, keys)
+	require.NoError(t, err)
+
+	token, exp, err := reopened.Get("user-1")
+	require.NoError(t, err)
+	require.Equal(t, "token-1", token)
+	require.True(t, exp.IsZero())
+}
+
+func TestFileTokenCache_CorruptFileFailsToUnseal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmapi-tokencache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens")
+	keys := newFixedKeySource()
+
+	cache, err := NewFileTokenCache(path, keys)
+	require.NoError(t, err)
+	require.NoError(t, cache.Set("user-1", "token-1", time.Time{}))
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	raw[len(raw)-1] ^= 0xFF // flip every bit of the last byte (part of the auth tag)
+	require.NoError(t, ioutil.WriteFile(path, raw, 0600))
+
+	_, _, err = cache.Get("user-1")
+	require.Error(t, err)
+}
+
+func TestFileTokenCache_WrongKeyFailsToUnseal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmapi-tokencache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens")
+
+	cache, err := NewFileTokenCache(path, newFixedKeySource())
+	require.NoError(t, err)
+	require.NoError(t, cache.Set("user-1", "token-1", time.Time{}))
+
+	wrongKeySource := &fixedKeySource{key: []byte("different-key-different-key-12!!")[:32]}
+	reopened, err := NewFileTokenCache(path, wrongKeySource)
+	require.NoError(t, err)
+
+	_, _, err = reopened.Get("user-1")
+	require.Error(t, err)
+}
+
+func TestClientManager_LoadTokensFromCache(t *testing.T) {
+	cache := newMemoryTokenCache()
+
+	require.NoError(t, cache.Set("expired-user", "stale-token", time.Now().Add(-time.Hour)))
+	require.NoError(t, cache.Set("active-user", "good-token", time.Now().Add(time.Hour)))
+	require.NoError(t, cache.Set("forever-user", "forever-token", time.Time{}))
+
+	cm := NewClientManager(&ClientConfig{}, WithTokenCache(cache))
+	defer cm.Close()
+
+	require.Equal(t, "", cm.GetToken("expired-user"))
+	require.Equal(t, "good-token", cm.GetToken("active-user"))
+	require.Equal(t, "forever-token", cm.GetToken("forever-user"))
+}